@@ -0,0 +1,172 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-shell/app/mux"
+	"github.com/mendersoftware/mender-shell/client/discovery"
+	"github.com/mendersoftware/mender-shell/config"
+)
+
+// defaultServerDiscoveryRefreshInterval is used when ServerDiscovery is
+// configured but RefreshInterval is left empty.
+const defaultServerDiscoveryRefreshInterval = 30 * time.Second
+
+// MenderShellDaemon holds the state of the running mender-shell daemon.
+// Configuration fields read by newly-started sessions (ServerURL, Servers,
+// ShellCommand, User, HTTPSClient) are protected by configLock so they can be
+// swapped out by Reconfigure while sessions are in flight.
+type MenderShellDaemon struct {
+	configLock sync.RWMutex
+	config     *config.MenderShellConfig
+
+	quit chan struct{}
+
+	sessionsLock sync.Mutex
+	sessions     map[*mux.Session]struct{}
+}
+
+// NewDaemon creates a new mender-shell daemon instance from the given
+// configuration.
+func NewDaemon(c *config.MenderShellConfig) *MenderShellDaemon {
+	return &MenderShellDaemon{
+		config:   c,
+		quit:     make(chan struct{}),
+		sessions: make(map[*mux.Session]struct{}),
+	}
+}
+
+// AttachWebsocket wraps a newly-established device-to-server websocket
+// connection in a mux.Session, so it can carry several concurrent logical
+// shell sessions instead of needing one websocket per session, and starts
+// reading frames off it in the background. Callers wire the returned
+// Session's OnOpen to whatever attaches a Stream to an actual shell process.
+func (d *MenderShellDaemon) AttachWebsocket(conn *websocket.Conn) *mux.Session {
+	c := d.Config()
+	session := mux.NewSession(conn, c.MaxStreamsPerConnection, c.StreamWriteBuffer)
+
+	d.sessionsLock.Lock()
+	d.sessions[session] = struct{}{}
+	d.sessionsLock.Unlock()
+
+	go func() {
+		if err := session.Run(); err != nil {
+			log.Debugf("mux session ended: %s", err.Error())
+		}
+		d.sessionsLock.Lock()
+		delete(d.sessions, session)
+		d.sessionsLock.Unlock()
+	}()
+
+	return session
+}
+
+// Config returns the daemon's current configuration. The returned value must
+// not be mutated by the caller; use Reconfigure instead.
+func (d *MenderShellDaemon) Config() *config.MenderShellConfig {
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+	return d.config
+}
+
+// Reconfigure atomically swaps in a new configuration. Sessions already
+// running keep using the configuration they were started with; only
+// newly-started sessions observe the new values.
+func (d *MenderShellDaemon) Reconfigure(c *config.MenderShellConfig) {
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	d.config = c
+	log.Info("Daemon: configuration reloaded")
+}
+
+// Run starts the daemon main loop and blocks until StopDaemon is called.
+func (d *MenderShellDaemon) Run() error {
+	if err := d.startServerDiscovery(); err != nil {
+		log.Errorf("Server discovery disabled: %s", err.Error())
+	}
+
+	<-d.quit
+	return nil
+}
+
+// startServerDiscovery builds the Provider described by the current
+// configuration's ServerDiscovery section, if any, and starts polling it in
+// the background. It returns immediately if no discovery backend is
+// configured, leaving the static Servers/ServerURL list as-is.
+func (d *MenderShellDaemon) startServerDiscovery() error {
+	c := d.Config()
+	provider, err := discovery.NewProvider(c.ServerDiscovery)
+	if err != nil {
+		return err
+	}
+	if provider == nil {
+		return nil
+	}
+
+	interval := defaultServerDiscoveryRefreshInterval
+	if c.ServerDiscovery.RefreshInterval != "" {
+		parsed, err := time.ParseDuration(c.ServerDiscovery.RefreshInterval)
+		if err != nil {
+			return err
+		}
+		interval = parsed
+	}
+
+	go d.runServerDiscovery(provider, interval)
+	return nil
+}
+
+// runServerDiscovery polls provider on the given interval and publishes a
+// refreshed Servers list through Reconfigure, so failover logic transparently
+// picks up newly appearing/disappearing servers without a restart, without
+// mutating the MenderShellConfig that existing Config() callers may be
+// holding onto.
+func (d *MenderShellDaemon) runServerDiscovery(provider discovery.Provider, interval time.Duration) {
+	refresh := func() {
+		urls, err := provider.Discover()
+		if err != nil {
+			log.Errorf("Server discovery failed: %s", err.Error())
+			return
+		}
+
+		next := *d.Config()
+		next.SetServers(urls)
+		d.Reconfigure(&next)
+		log.Debugf("Server discovery refreshed %d server(s)", len(urls))
+	}
+
+	refresh()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			refresh()
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// StopDaemon requests the daemon main loop to exit.
+func (d *MenderShellDaemon) StopDaemon() {
+	close(d.quit)
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mendersoftware/mender-shell/config"
+)
+
+// fakeDiscoveryProvider stands in for a real discovery.Provider (e.g.
+// Consul), signalling Discover calls on called (without blocking when the
+// channel is full) so tests can wait for a call without polling.
+type fakeDiscoveryProvider struct {
+	urls   []string
+	called chan struct{}
+}
+
+func (f *fakeDiscoveryProvider) Discover() ([]string, error) {
+	select {
+	case f.called <- struct{}{}:
+	default:
+	}
+	return f.urls, nil
+}
+
+func TestReconfigureSwapsConfigWithoutMutatingPrevious(t *testing.T) {
+	initial := config.NewMenderShellConfig()
+	initial.ShellCommand = "/bin/sh"
+	d := NewDaemon(initial)
+
+	require.Same(t, initial, d.Config())
+
+	next := config.NewMenderShellConfig()
+	next.ShellCommand = "/bin/bash"
+	d.Reconfigure(next)
+
+	assert.Same(t, next, d.Config())
+	assert.Equal(t, "/bin/sh", initial.ShellCommand,
+		"a config previously handed out by Config() must not be mutated by a later Reconfigure")
+}
+
+// TestRunServerDiscoveryPublishesWithoutMutatingPreviousConfig exercises the
+// refresh path runServerDiscovery uses to publish a newly discovered server
+// list, and guards against it mutating a config object a caller may already
+// be holding onto via Config().
+func TestRunServerDiscoveryPublishesWithoutMutatingPreviousConfig(t *testing.T) {
+	initial := config.NewMenderShellConfig()
+	initial.SetServers([]string{"https://static.example.com"})
+	d := NewDaemon(initial)
+
+	provider := &fakeDiscoveryProvider{
+		urls:   []string{"https://dynamic.example.com"},
+		called: make(chan struct{}, 1),
+	}
+	go d.runServerDiscovery(provider, time.Hour)
+	defer d.StopDaemon()
+
+	select {
+	case <-provider.called:
+	case <-time.After(time.Second):
+		t.Fatal("provider was never polled")
+	}
+
+	require.Eventually(t, func() bool {
+		servers := d.Config().Servers
+		return len(servers) == 1 && servers[0].ServerURL == "https://dynamic.example.com"
+	}, time.Second, 10*time.Millisecond, "discovered servers were never published via Reconfigure")
+
+	require.Len(t, initial.Servers, 1)
+	assert.Equal(t, "https://static.example.com", initial.Servers[0].ServerURL,
+		"the config object the daemon started with must not be mutated by a discovery refresh")
+}
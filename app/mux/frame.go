@@ -0,0 +1,120 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package mux implements a small stream multiplexer that lets a single
+// device-to-server websocket connection carry several concurrent logical
+// shell sessions, instead of requiring one websocket per session.
+package mux
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// FrameType identifies the purpose of a Frame.
+type FrameType byte
+
+const (
+	// FrameOpen starts a new logical session identified by SessionID.
+	FrameOpen FrameType = iota
+	// FrameData carries shell input/output for an open session.
+	FrameData
+	// FrameResize carries a terminal resize event for an open session.
+	FrameResize
+	// FrameClose tears down a logical session.
+	FrameClose
+	// FramePing is a keep-alive with no session semantics.
+	FramePing
+)
+
+// headerLen is session-id (16 bytes, zero-padded) + frame-type (1 byte) +
+// payload length (4 bytes, big-endian).
+const headerLen = 16 + 1 + 4
+
+// maxPayloadLen bounds a single frame's payload so that a malformed or
+// malicious length field cannot force an unbounded allocation.
+const maxPayloadLen = 1 << 20 // 1 MiB
+
+// Frame is a single multiplexed unit on top of a websocket binary message:
+// session-id + frame-type + length + payload.
+type Frame struct {
+	SessionID string
+	Type      FrameType
+	Payload   []byte
+}
+
+// encodeSessionID packs a session ID of at most 16 bytes (such as the 16 hex
+// characters produced by newSessionID) into a fixed-size, zero-padded field.
+func encodeSessionID(id string) ([]byte, error) {
+	if len(id) > 16 {
+		return nil, errors.Errorf("mux: session ID %q longer than 16 bytes", id)
+	}
+	buf := make([]byte, 16)
+	copy(buf, id)
+	return buf, nil
+}
+
+func decodeSessionID(buf []byte) string {
+	end := len(buf)
+	for end > 0 && buf[end-1] == 0 {
+		end--
+	}
+	return string(buf[:end])
+}
+
+// Encode serializes the frame for writing as a websocket binary message.
+func (f Frame) Encode() ([]byte, error) {
+	sessionID, err := encodeSessionID(f.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Payload) > maxPayloadLen {
+		return nil, errors.Errorf("mux: frame payload too large (%d bytes)", len(f.Payload))
+	}
+
+	buf := make([]byte, headerLen+len(f.Payload))
+	copy(buf[0:16], sessionID)
+	buf[16] = byte(f.Type)
+	binary.BigEndian.PutUint32(buf[17:21], uint32(len(f.Payload)))
+	copy(buf[headerLen:], f.Payload)
+	return buf, nil
+}
+
+// DecodeFrame parses a websocket binary message back into a Frame.
+func DecodeFrame(data []byte) (Frame, error) {
+	if len(data) < headerLen {
+		return Frame{}, errors.New("mux: frame shorter than header")
+	}
+
+	sessionID := decodeSessionID(data[0:16])
+	frameType := FrameType(data[16])
+	length := binary.BigEndian.Uint32(data[17:21])
+	if length > maxPayloadLen {
+		return Frame{}, errors.Errorf("mux: frame declares payload too large (%d bytes)", length)
+	}
+	if uint32(len(data)-headerLen) != length {
+		return Frame{}, errors.Errorf(
+			"mux: frame length mismatch: header says %d, got %d", length, len(data)-headerLen)
+	}
+
+	payload := make([]byte, length)
+	copy(payload, data[headerLen:])
+
+	return Frame{
+		SessionID: sessionID,
+		Type:      frameType,
+		Payload:   payload,
+	}, nil
+}
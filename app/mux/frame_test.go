@@ -0,0 +1,63 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package mux
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameEncodeDecodeRoundTrip(t *testing.T) {
+	frame := Frame{
+		SessionID: "abcdef0123456789",
+		Type:      FrameData,
+		Payload:   []byte("hello world"),
+	}
+
+	data, err := frame.Encode()
+	require.NoError(t, err)
+
+	decoded, err := DecodeFrame(data)
+	require.NoError(t, err)
+	assert.Equal(t, frame, decoded)
+}
+
+func TestFrameEncodeRejectsOversizedSessionID(t *testing.T) {
+	frame := Frame{SessionID: strings.Repeat("x", 17), Type: FramePing}
+	_, err := frame.Encode()
+	assert.Error(t, err)
+}
+
+func TestFrameEncodeRejectsOversizedPayload(t *testing.T) {
+	frame := Frame{SessionID: "abc", Type: FrameData, Payload: make([]byte, maxPayloadLen+1)}
+	_, err := frame.Encode()
+	assert.Error(t, err)
+}
+
+func TestDecodeFrameRejectsTruncatedHeader(t *testing.T) {
+	_, err := DecodeFrame([]byte{0x01, 0x02})
+	assert.Error(t, err)
+}
+
+func TestDecodeFrameRejectsLengthMismatch(t *testing.T) {
+	frame := Frame{SessionID: "abc", Type: FrameData, Payload: []byte("payload")}
+	data, err := frame.Encode()
+	require.NoError(t, err)
+
+	_, err = DecodeFrame(data[:len(data)-1])
+	assert.Error(t, err)
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package mux
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// OpenHandler is called whenever the remote side opens a new logical
+// session; it is expected to attach the given Stream to whatever consumes
+// it (typically a PTY-backed shell process).
+type OpenHandler func(stream *Stream, openPayload []byte)
+
+// Session owns a single websocket connection and dispatches inbound frames
+// to the per-session Streams keyed by session ID, so that several logical
+// shell sessions can share the one connection.
+type Session struct {
+	conn *websocket.Conn
+
+	maxStreams  int
+	writeBuffer int
+
+	onOpen OpenHandler
+
+	mu      sync.Mutex
+	streams map[string]*Stream
+	writeMu sync.Mutex
+}
+
+// NewSession wraps conn in a Session. maxStreams caps the number of
+// concurrently open logical sessions (0 means unlimited); writeBuffer sets
+// the per-stream inbound buffer size.
+func NewSession(conn *websocket.Conn, maxStreams int, writeBuffer int) *Session {
+	return &Session{
+		conn:        conn,
+		maxStreams:  maxStreams,
+		writeBuffer: writeBuffer,
+		streams:     make(map[string]*Stream),
+	}
+}
+
+// OnOpen registers the handler invoked for every OPEN frame received from
+// the remote side.
+func (s *Session) OnOpen(handler OpenHandler) {
+	s.onOpen = handler
+}
+
+// Open starts a new logical session from this side (e.g. a locally spawned
+// pane), sending an OPEN frame and returning the Stream newly-started shell
+// processes should attach to.
+func (s *Session) Open(openPayload []byte) (*Stream, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := s.register(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.send(Frame{SessionID: id, Type: FrameOpen, Payload: openPayload}); err != nil {
+		s.forget(id)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// Run reads frames off the websocket connection until it is closed or an
+// unrecoverable error occurs, dispatching each to its Stream (creating one,
+// via OnOpen, for OPEN frames from the remote side).
+func (s *Session) Run() error {
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			s.closeAllStreams()
+			return err
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		frame, err := DecodeFrame(data)
+		if err != nil {
+			log.Errorf("mux: dropping malformed frame: %s", err.Error())
+			continue
+		}
+
+		s.dispatch(frame)
+	}
+}
+
+func (s *Session) dispatch(frame Frame) {
+	switch frame.Type {
+	case FramePing:
+		return
+	case FrameOpen:
+		stream, err := s.register(frame.SessionID)
+		if err != nil {
+			log.Errorf("mux: %s", err.Error())
+			return
+		}
+		if s.onOpen != nil {
+			s.onOpen(stream, frame.Payload)
+		}
+	case FrameData:
+		if stream := s.lookup(frame.SessionID); stream != nil {
+			stream.deliver(frame.Payload)
+		} else {
+			log.Debugf("mux: frame for unknown session %s dropped", frame.SessionID)
+		}
+	case FrameResize:
+		if stream := s.lookup(frame.SessionID); stream != nil {
+			stream.deliverResize(frame.Payload)
+		} else {
+			log.Debugf("mux: frame for unknown session %s dropped", frame.SessionID)
+		}
+	case FrameClose:
+		if stream := s.lookup(frame.SessionID); stream != nil {
+			stream.closeLocal()
+		}
+	default:
+		log.Debugf("mux: unknown frame type %d for session %s", frame.Type, frame.SessionID)
+	}
+}
+
+func (s *Session) register(id string) (*Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxStreams > 0 && len(s.streams) >= s.maxStreams {
+		return nil, errors.Errorf(
+			"mux: refusing to open session %s: MaxStreamsPerConnection (%d) reached", id, s.maxStreams)
+	}
+	if _, exists := s.streams[id]; exists {
+		return nil, errors.Errorf("mux: session %s already open", id)
+	}
+
+	stream := newStream(id, s, s.writeBuffer)
+	s.streams[id] = stream
+	return stream, nil
+}
+
+func (s *Session) lookup(id string) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) forget(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+func (s *Session) closeAllStreams() {
+	s.mu.Lock()
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.mu.Unlock()
+
+	for _, stream := range streams {
+		stream.closeLocal()
+	}
+}
+
+// send writes a frame to the websocket connection. The connection only
+// tolerates one writer at a time, so concurrent Stream writes are
+// serialized here.
+func (s *Session) send(frame Frame) error {
+	data, err := frame.Encode()
+	if err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func newSessionID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", buf)[:16], nil
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package mux
+
+import (
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type frameKind int
+
+const (
+	kindData frameKind = iota
+	kindResize
+)
+
+func (k frameKind) String() string {
+	switch k {
+	case kindData:
+		return "DATA"
+	case kindResize:
+		return "RESIZE"
+	default:
+		return "unknown"
+	}
+}
+
+type queuedFrame struct {
+	kind    frameKind
+	payload []byte
+}
+
+// minQueueCapacity is the smallest stream queue capacity, used when
+// writeBuffer is 0 (meaning "unbuffered", as for the inbox channel), so that
+// a zero-capacity queue does not make enqueue drop every frame.
+const minQueueCapacity = 1
+
+// Stream is an io.ReadWriteCloser-shaped handle onto one logical session
+// multiplexed over a Session's websocket connection. Each shell process
+// reads/writes through a Stream rather than touching the connection
+// directly.
+//
+// Frames handed to deliver/deliverResize by the Session's shared read loop
+// are queued, up to a StreamWriteBuffer-sized bound, and drained by a
+// dedicated per-stream goroutine. This way one stream whose consumer is slow
+// (or stuck) cannot stall frame dispatch for every other session
+// multiplexed over the same connection, and cannot grow without bound
+// either: once its queue fills, further frames for it are dropped.
+type Stream struct {
+	ID string
+
+	session *Session
+
+	onResize func(payload []byte)
+
+	inbox chan []byte
+	rest  []byte
+
+	queueMu   sync.Mutex
+	queueCond *sync.Cond
+	queue     []queuedFrame
+	queueCap  int
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newStream(id string, session *Session, writeBuffer int) *Stream {
+	queueCap := writeBuffer
+	if queueCap < minQueueCapacity {
+		queueCap = minQueueCapacity
+	}
+
+	s := &Stream{
+		ID:       id,
+		session:  session,
+		inbox:    make(chan []byte, writeBuffer),
+		queueCap: queueCap,
+		closed:   make(chan struct{}),
+	}
+	s.queueCond = sync.NewCond(&s.queueMu)
+	go s.dispatchLoop()
+	return s
+}
+
+// OnResize registers the callback invoked for RESIZE frames received for
+// this stream, mirroring the outbound Resize method. Typically wired up
+// right after the stream is handed to an OnOpen handler or returned from
+// Session.Open.
+func (s *Stream) OnResize(handler func(payload []byte)) {
+	s.queueMu.Lock()
+	s.onResize = handler
+	s.queueMu.Unlock()
+}
+
+// Read implements io.Reader, returning DATA payloads received for this
+// stream's session ID, in order.
+func (s *Stream) Read(p []byte) (int, error) {
+	for len(s.rest) == 0 {
+		select {
+		case data, ok := <-s.inbox:
+			if !ok {
+				return 0, io.EOF
+			}
+			s.rest = data
+		case <-s.closed:
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, s.rest)
+	s.rest = s.rest[n:]
+	return n, nil
+}
+
+// Write implements io.Writer, sending p as a DATA frame to the server over
+// the owning Session.
+func (s *Stream) Write(p []byte) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, errors.Errorf("mux: stream %s is closed", s.ID)
+	default:
+	}
+
+	if err := s.session.send(Frame{SessionID: s.ID, Type: FrameData, Payload: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Resize sends a RESIZE frame for this stream's session.
+func (s *Stream) Resize(payload []byte) error {
+	return s.session.send(Frame{SessionID: s.ID, Type: FrameResize, Payload: payload})
+}
+
+// Close implements io.Closer. It notifies the server that the session ended
+// and releases local resources; it is safe to call more than once.
+func (s *Stream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.session.forget(s.ID)
+		err = s.session.send(Frame{SessionID: s.ID, Type: FrameClose})
+		s.signalClosed()
+	})
+	return err
+}
+
+// deliver queues a DATA payload received from the server for Read. Called
+// inline from the session's shared dispatch loop, so it must never block.
+func (s *Stream) deliver(payload []byte) {
+	s.enqueue(queuedFrame{kind: kindData, payload: payload})
+}
+
+// deliverResize queues a RESIZE payload received from the server for
+// OnResize, keeping it out of the DATA stream that Read hands to the shell
+// process. Called inline from the session's shared dispatch loop, so it
+// must never block.
+func (s *Stream) deliverResize(payload []byte) {
+	s.enqueue(queuedFrame{kind: kindResize, payload: payload})
+}
+
+// enqueue appends frame to the stream's own queue, bounded by queueCap
+// (sized from StreamWriteBuffer, the same limit the inbox channel honours),
+// and wakes dispatchLoop. It never blocks, so the caller (the session's
+// shared read loop) cannot be stalled by a slow consumer on this stream; once
+// the queue is full it drops the new frame rather than growing without
+// bound, which would let one stuck stream exhaust memory.
+func (s *Stream) enqueue(frame queuedFrame) {
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+
+	s.queueMu.Lock()
+	if len(s.queue) >= s.queueCap {
+		s.queueMu.Unlock()
+		log.Warnf("mux: stream %s queue full (cap %d), dropping %s frame",
+			s.ID, s.queueCap, frame.kind)
+		return
+	}
+	s.queue = append(s.queue, frame)
+	s.queueMu.Unlock()
+	s.queueCond.Signal()
+}
+
+// dispatchLoop drains this stream's queue, in order, forwarding DATA frames
+// to Read via inbox and RESIZE frames to onResize. It runs on its own
+// goroutine so that a blocked inbox (an unread Stream) only blocks itself.
+func (s *Stream) dispatchLoop() {
+	for {
+		s.queueMu.Lock()
+		for len(s.queue) == 0 {
+			select {
+			case <-s.closed:
+				s.queueMu.Unlock()
+				return
+			default:
+			}
+			s.queueCond.Wait()
+		}
+		frame := s.queue[0]
+		s.queue = s.queue[1:]
+		onResize := s.onResize
+		s.queueMu.Unlock()
+
+		switch frame.kind {
+		case kindData:
+			select {
+			case s.inbox <- frame.payload:
+			case <-s.closed:
+				return
+			}
+		case kindResize:
+			if onResize != nil {
+				onResize(frame.payload)
+			}
+		}
+	}
+}
+
+// signalClosed marks the stream closed and wakes dispatchLoop so it can
+// exit.
+func (s *Stream) signalClosed() {
+	close(s.closed)
+	s.queueMu.Lock()
+	s.queueCond.Broadcast()
+	s.queueMu.Unlock()
+}
+
+// closeLocal tears down the stream without notifying the server again, used
+// when the server itself sent the CLOSE frame.
+func (s *Stream) closeLocal() {
+	s.closeOnce.Do(func() {
+		s.session.forget(s.ID)
+		s.signalClosed()
+	})
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package mux
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStreamDeliverAndResizeAreSeparateChannels guards against RESIZE frames
+// leaking into the DATA stream that Read hands to the shell process.
+func TestStreamDeliverAndResizeAreSeparateChannels(t *testing.T) {
+	s := newStream("test-session", nil, 4)
+	defer s.signalClosed()
+
+	resizes := make(chan []byte, 1)
+	s.OnResize(func(payload []byte) { resizes <- payload })
+
+	s.deliver([]byte("hello"))
+	s.deliverResize([]byte("80x24"))
+	s.deliver([]byte("world"))
+
+	buf := make([]byte, 64)
+	n, err := s.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	select {
+	case payload := <-resizes:
+		assert.Equal(t, "80x24", string(payload))
+	case <-time.After(time.Second):
+		t.Fatal("resize callback was not invoked")
+	}
+
+	n, err = s.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(buf[:n]))
+}
+
+// TestStreamEnqueueDropsFramesOnceQueueFull is the regression test for the
+// unbounded s.queue growth: with nothing draining Read, the queue must stop
+// growing at queueCap instead of buffering every frame handed to it.
+func TestStreamEnqueueDropsFramesOnceQueueFull(t *testing.T) {
+	s := newStream("test-session", nil, 2)
+	defer s.signalClosed()
+
+	for i := 0; i < 50; i++ {
+		s.deliver([]byte(fmt.Sprintf("frame-%d", i)))
+	}
+
+	// Give dispatchLoop a chance to move a frame out of the queue and
+	// block trying to push it into the (now full, undrained) inbox.
+	time.Sleep(50 * time.Millisecond)
+
+	s.queueMu.Lock()
+	queued := len(s.queue)
+	s.queueMu.Unlock()
+
+	assert.LessOrEqualf(t, queued, s.queueCap,
+		"queue length %d exceeds queueCap %d: enqueue is not bounded", queued, s.queueCap)
+}
+
+// TestStreamConcurrentDeliverDoesNotRace exercises deliver/deliverResize from
+// many goroutines (standing in for Session's shared read loop racing against
+// itself) concurrently with a consumer draining Read, and must be run with
+// -race to be meaningful.
+func TestStreamConcurrentDeliverDoesNotRace(t *testing.T) {
+	s := newStream("test-session", nil, 8)
+
+	s.OnResize(func(payload []byte) {})
+
+	const producers = 8
+	const framesPerProducer = 200
+
+	var received int64
+	done := make(chan struct{})
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := s.Read(buf)
+			if err != nil {
+				if err != io.EOF {
+					t.Error(err)
+				}
+				close(done)
+				return
+			}
+			atomic.AddInt64(&received, int64(n))
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < framesPerProducer; i++ {
+				if i%2 == 0 {
+					s.deliverResize([]byte("resize"))
+				} else {
+					s.deliver([]byte("x"))
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	time.Sleep(50 * time.Millisecond)
+	s.signalClosed()
+	<-done
+}
@@ -18,6 +18,8 @@ import (
 	"os/signal"
 	"syscall"
 
+	log "github.com/sirupsen/logrus"
+
 	"github.com/mendersoftware/mender-shell/app"
 	"github.com/mendersoftware/mender-shell/config"
 )
@@ -25,6 +27,7 @@ import (
 type runOptionsType struct {
 	config         string
 	fallbackConfig string
+	configDirs     []string
 }
 
 func initDaemon(config *config.MenderConfig) (*app.MenderShellDaemon, error) {
@@ -36,15 +39,39 @@ func runDaemon(d *app.MenderShellDaemon) error {
 	// Handle user forcing update check.
 	go func() {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGTERM)
+		signal.Notify(c, syscall.SIGTERM, syscall.SIGHUP)
 		defer signal.Stop(c)
 
 		for {
 			s := <-c // Block until a signal is received.
-			if s == syscall.SIGTERM {
+			switch s {
+			case syscall.SIGTERM:
 				d.StopDaemon()
+			case syscall.SIGHUP:
+				reloadConfig(d)
 			}
 		}
 	}()
 	return d.Run()
 }
+
+// reloadConfig re-reads the configuration files backing the running daemon
+// and hands the result to the daemon, without disturbing sessions already in
+// progress. Only newly-started sessions will see the new values.
+func reloadConfig(d *app.MenderShellDaemon) {
+	cur := d.Config()
+	log.Info("SIGHUP received, reloading configuration")
+
+	newConfig, err := config.LoadConfig(cur.MainConfigFile, cur.FallbackConfigFile, cur.ConfigDirs...)
+	if err != nil {
+		log.Errorf("Failed to reload configuration: %s. Keeping current configuration.", err.Error())
+		return
+	}
+
+	if err := newConfig.Validate(); err != nil {
+		log.Errorf("Reloaded configuration is invalid: %s. Keeping current configuration.", err.Error())
+		return
+	}
+
+	d.Reconfigure(newConfig)
+}
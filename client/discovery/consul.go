@@ -0,0 +1,108 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package discovery
+
+import (
+	"fmt"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+// ConsulTLSConfig configures TLS towards the Consul agent.
+type ConsulTLSConfig struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// ConsulConfig is the Consul backend of ServerDiscovery: mender-shell
+// queries Consul's catalog for healthy instances of Service, optionally
+// filtered by Tag.
+type ConsulConfig struct {
+	Address    string
+	Datacenter string
+	Service    string
+	Tag        string
+	// Scheme is used both to reach the Consul agent's API and to build
+	// the server URLs returned by Discover. When empty, the Consul
+	// client's default scheme is used for the API and Discover builds
+	// https URLs.
+	Scheme string
+	Token  string
+	TLS    ConsulTLSConfig
+}
+
+type consulProvider struct {
+	client *consulapi.Client
+	cfg    ConsulConfig
+}
+
+func newConsulProvider(cfg ConsulConfig) (Provider, error) {
+	if cfg.Service == "" {
+		return nil, errors.New("ServerDiscovery.Consul.Service must be set")
+	}
+
+	apiCfg := consulapi.DefaultConfig()
+	if cfg.Address != "" {
+		apiCfg.Address = cfg.Address
+	}
+	if cfg.Datacenter != "" {
+		apiCfg.Datacenter = cfg.Datacenter
+	}
+	if cfg.Scheme != "" {
+		apiCfg.Scheme = cfg.Scheme
+	}
+	if cfg.Token != "" {
+		apiCfg.Token = cfg.Token
+	}
+	apiCfg.TLSConfig = consulapi.TLSConfig{
+		CAFile:             cfg.TLS.CAFile,
+		CertFile:           cfg.TLS.CertFile,
+		KeyFile:            cfg.TLS.KeyFile,
+		InsecureSkipVerify: cfg.TLS.InsecureSkipVerify,
+	}
+
+	client, err := consulapi.NewClient(apiCfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create Consul client")
+	}
+
+	return &consulProvider{client: client, cfg: cfg}, nil
+}
+
+// Discover queries Consul's catalog for the currently healthy instances of
+// the configured service and returns their server URLs.
+func (p *consulProvider) Discover() ([]string, error) {
+	entries, _, err := p.client.Health().Service(p.cfg.Service, p.cfg.Tag, true, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query Consul catalog for service %q", p.cfg.Service)
+	}
+
+	scheme := p.cfg.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	urls := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		addr := entry.Service.Address
+		if addr == "" {
+			addr = entry.Node.Address
+		}
+		urls = append(urls, fmt.Sprintf("%s://%s:%d", scheme, addr, entry.Service.Port))
+	}
+	return urls, nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package discovery resolves the dynamic server list used as an alternative
+// to the static Servers/ServerURL configuration, by polling a backend such
+// as Consul's service catalog.
+package discovery
+
+// Provider resolves the currently healthy server URLs for a dynamic
+// discovery backend (Consul, DNS-SRV, ...), so that MenderShellConfig.Servers
+// can be kept up to date without a restart.
+type Provider interface {
+	Discover() ([]string, error)
+}
+
+// Config is the ServerDiscovery configuration section. The static
+// Servers/ServerURL path remains the default when no provider is
+// configured.
+type Config struct {
+	Consul *ConsulConfig
+	// RefreshInterval controls how often the configured provider is
+	// polled, as a duration string (e.g. "30s"). Defaults to 30s.
+	RefreshInterval string
+}
+
+// NewProvider builds the Provider described by cfg, or returns (nil, nil)
+// when no backend is configured, in which case the static Servers/ServerURL
+// path should be used instead.
+func NewProvider(cfg Config) (Provider, error) {
+	switch {
+	case cfg.Consul != nil:
+		return newConsulProvider(*cfg.Consul)
+	default:
+		return nil, nil
+	}
+}
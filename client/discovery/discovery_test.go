@@ -0,0 +1,38 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package discovery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewProviderReturnsNilWhenNoBackendConfigured(t *testing.T) {
+	provider, err := NewProvider(Config{})
+	require.NoError(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestNewProviderRejectsConsulConfigWithoutService(t *testing.T) {
+	_, err := NewProvider(Config{Consul: &ConsulConfig{Address: "127.0.0.1:8500"}})
+	assert.Error(t, err)
+}
+
+func TestNewProviderBuildsConsulProvider(t *testing.T) {
+	provider, err := NewProvider(Config{Consul: &ConsulConfig{Service: "mender-shell"}})
+	require.NoError(t, err)
+	assert.NotNil(t, provider)
+}
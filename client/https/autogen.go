@@ -0,0 +1,200 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package https
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAutoGenerateValidity    = 365 * 24 * time.Hour
+	defaultAutoGenerateRenewBefore = 30 * 24 * time.Hour
+)
+
+// ensureAutoGenerated makes sure a client certificate/key pair exists at
+// k.Certificate/k.Key, generating and persisting a self-signed one if they
+// are missing, or if the existing certificate is within
+// AutoGenerateRenewBefore of expiry.
+func (k *Client) ensureAutoGenerated() error {
+	needsGeneration, err := k.needsAutoGeneratedCertificate()
+	if err != nil {
+		return err
+	}
+	if !needsGeneration {
+		if _, err := os.Stat(k.Key); !os.IsNotExist(err) {
+			return nil
+		}
+	}
+
+	validity, err := parseDurationOrDefault(k.AutoGenerateValidity, defaultAutoGenerateValidity)
+	if err != nil {
+		return errors.Wrap(err, "invalid HttpsClient.AutoGenerateValidity")
+	}
+
+	certPEM, keyPEM, err := generateSelfSignedECDSACertificate(k.AutoGenerateHosts, validity)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate self-signed client certificate")
+	}
+
+	if err := writeFileAtomically(k.Key, keyPEM, 0600); err != nil {
+		return errors.Wrap(err, "failed to write generated client key")
+	}
+	if err := writeFileAtomically(k.Certificate, certPEM, 0644); err != nil {
+		return errors.Wrap(err, "failed to write generated client certificate")
+	}
+
+	log.Infof("Generated self-signed client certificate %s (fingerprint sha256:%s); "+
+		"pin this on the server if it authenticates devices by certificate",
+		k.Certificate, certificateFingerprint(certPEM))
+
+	return nil
+}
+
+// needsAutoGeneratedCertificate reports whether the configured certificate
+// is missing, or present but close enough to expiry to need regenerating.
+func (k *Client) needsAutoGeneratedCertificate() (bool, error) {
+	certPEM, err := ioutil.ReadFile(k.Certificate)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return false, errors.Errorf("%s does not contain a valid PEM certificate", k.Certificate)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to parse %s", k.Certificate)
+	}
+
+	renewBefore, err := parseDurationOrDefault(k.AutoGenerateRenewBefore, defaultAutoGenerateRenewBefore)
+	if err != nil {
+		return false, errors.Wrap(err, "invalid HttpsClient.AutoGenerateRenewBefore")
+	}
+
+	return time.Until(cert.NotAfter) < renewBefore, nil
+}
+
+func generateSelfSignedECDSACertificate(hosts []string, validity time.Duration) (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   "mender-shell",
+			Organization: []string{"Northern.tech AS"},
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func certificateFingerprint(certPEM []byte) string {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return ""
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return fingerprintHex(sum[:])
+}
+
+func fingerprintHex(sum []byte) string {
+	const hexDigits = "0123456789abcdef"
+	out := make([]byte, 0, len(sum)*3-1)
+	for i, b := range sum {
+		if i > 0 {
+			out = append(out, ':')
+		}
+		out = append(out, hexDigits[b>>4], hexDigits[b&0x0f])
+	}
+	return string(out)
+}
+
+func writeFileAtomically(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
+
+func parseDurationOrDefault(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
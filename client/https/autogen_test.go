@@ -0,0 +1,149 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package https
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureAutoGeneratedCreatesCertificateAndKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-autogen")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := &Client{
+		Certificate:       filepath.Join(dir, "client.crt"),
+		Key:               filepath.Join(dir, "client.key"),
+		AutoGenerate:      true,
+		AutoGenerateHosts: []string{"device.local", "127.0.0.1"},
+	}
+
+	err = client.ensureAutoGenerated()
+	require.NoError(t, err)
+
+	certInfo, err := os.Stat(client.Certificate)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), certInfo.Mode().Perm())
+
+	keyInfo, err := os.Stat(client.Key)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), keyInfo.Mode().Perm())
+
+	certPEM, err := ioutil.ReadFile(client.Certificate)
+	require.NoError(t, err)
+	certBlock, _ := pem.Decode(certPEM)
+	require.NotNil(t, certBlock)
+	assert.Equal(t, "CERTIFICATE", certBlock.Type)
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	require.NoError(t, err)
+	assert.Contains(t, cert.DNSNames, "device.local")
+	require.Len(t, cert.IPAddresses, 1)
+	assert.Equal(t, "127.0.0.1", cert.IPAddresses[0].String())
+	assert.WithinDuration(t, time.Now().Add(defaultAutoGenerateValidity), cert.NotAfter, time.Hour)
+
+	keyPEM, err := ioutil.ReadFile(client.Key)
+	require.NoError(t, err)
+	keyBlock, _ := pem.Decode(keyPEM)
+	require.NotNil(t, keyBlock)
+	assert.Equal(t, "EC PRIVATE KEY", keyBlock.Type)
+}
+
+func TestEnsureAutoGeneratedLeavesFreshCertificateAlone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-autogen")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := &Client{
+		Certificate:  filepath.Join(dir, "client.crt"),
+		Key:          filepath.Join(dir, "client.key"),
+		AutoGenerate: true,
+	}
+	require.NoError(t, client.ensureAutoGenerated())
+
+	before, err := ioutil.ReadFile(client.Certificate)
+	require.NoError(t, err)
+
+	require.NoError(t, client.ensureAutoGenerated())
+
+	after, err := ioutil.ReadFile(client.Certificate)
+	require.NoError(t, err)
+	assert.Equal(t, before, after, "a still-valid certificate should not be regenerated")
+}
+
+func TestNeedsAutoGeneratedCertificateRenewsNearExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-autogen")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certPEM, keyPEM, err := generateSelfSignedECDSACertificate(nil, time.Hour)
+	require.NoError(t, err)
+
+	client := &Client{
+		Certificate:             filepath.Join(dir, "client.crt"),
+		Key:                     filepath.Join(dir, "client.key"),
+		AutoGenerateRenewBefore: "24h",
+	}
+	require.NoError(t, ioutil.WriteFile(client.Certificate, certPEM, 0644))
+	require.NoError(t, ioutil.WriteFile(client.Key, keyPEM, 0600))
+
+	needsRenewal, err := client.needsAutoGeneratedCertificate()
+	require.NoError(t, err)
+	assert.True(t, needsRenewal, "a certificate expiring within AutoGenerateRenewBefore should be flagged for renewal")
+}
+
+func TestNeedsAutoGeneratedCertificateKeepsFreshCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-autogen")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certPEM, keyPEM, err := generateSelfSignedECDSACertificate(nil, defaultAutoGenerateValidity)
+	require.NoError(t, err)
+
+	client := &Client{
+		Certificate:             filepath.Join(dir, "client.crt"),
+		Key:                     filepath.Join(dir, "client.key"),
+		AutoGenerateRenewBefore: "24h",
+	}
+	require.NoError(t, ioutil.WriteFile(client.Certificate, certPEM, 0644))
+	require.NoError(t, ioutil.WriteFile(client.Key, keyPEM, 0600))
+
+	needsRenewal, err := client.needsAutoGeneratedCertificate()
+	require.NoError(t, err)
+	assert.False(t, needsRenewal, "a certificate far from expiry should not be flagged for renewal")
+}
+
+func TestNeedsAutoGeneratedCertificateMissingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-autogen")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := &Client{
+		Certificate: filepath.Join(dir, "does-not-exist.crt"),
+		Key:         filepath.Join(dir, "does-not-exist.key"),
+	}
+
+	needsRenewal, err := client.needsAutoGeneratedCertificate()
+	require.NoError(t, err)
+	assert.True(t, needsRenewal)
+}
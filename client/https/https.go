@@ -0,0 +1,105 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package https
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// MenderServer holds the configuration of a single server mender-shell can
+// connect to.
+type MenderServer struct {
+	ServerURL string
+}
+
+// Client holds the configuration of the HTTPS client used for mutual TLS
+// towards the Mender server.
+type Client struct {
+	// Path, or vault:// URI (see ResolvePEM), to the client certificate.
+	Certificate string
+	// Path, or vault:// URI (see ResolvePEM), to the client private key.
+	Key string
+
+	// CertificatePEM/KeyPEM hold the resolved, in-memory PEM material for
+	// Certificate/Key once Resolve has been called.
+	CertificatePEM []byte
+	KeyPEM         []byte
+
+	// AutoGenerate, when true, makes mender-shell generate and persist a
+	// self-signed ECDSA client certificate/key at Certificate/Key if
+	// those paths (which must then be plain filesystem paths, not
+	// vault:// URIs) do not already exist.
+	AutoGenerate bool
+	// AutoGenerateHosts lists the Subject Alternative Names (DNS names or
+	// IP addresses) embedded in the generated certificate.
+	AutoGenerateHosts []string
+	// AutoGenerateValidity is how long a generated certificate is valid
+	// for, as a duration string (e.g. "8760h"). Defaults to one year.
+	AutoGenerateValidity string
+	// AutoGenerateRenewBefore triggers regeneration once the certificate
+	// is within this duration of expiry (e.g. "720h"). Defaults to 30 days.
+	AutoGenerateRenewBefore string
+}
+
+// Resolve loads the PEM material for Certificate and Key, generating a
+// self-signed pair first if AutoGenerate is set and none exists yet, and
+// following vault:// URIs through vault if configured. The result is stored
+// on CertificatePEM/KeyPEM.
+func (k *Client) Resolve(vault VaultConfig) error {
+	if k == nil || k.Certificate == "" || k.Key == "" {
+		return nil
+	}
+
+	if k.AutoGenerate && !IsVaultURI(k.Certificate) && !IsVaultURI(k.Key) {
+		if err := k.ensureAutoGenerated(); err != nil {
+			return err
+		}
+	}
+
+	cert, err := ResolvePEM(k.Certificate, vault)
+	if err != nil {
+		return err
+	}
+	key, err := ResolvePEM(k.Key, vault)
+	if err != nil {
+		return err
+	}
+
+	k.CertificatePEM = cert
+	k.KeyPEM = key
+	return nil
+}
+
+// Config is the configuration consumed by the HTTP client constructor.
+type Config struct {
+	// Path to the server certificate, or to a directory of trusted CAs.
+	ServerCert string
+	// Whether the configured protocol is "https".
+	IsHTTPS bool
+	// Client, when set, enables mutual TLS using this client certificate.
+	Client *Client
+	// NoVerify disables server certificate verification.
+	NoVerify bool
+}
+
+// Validate logs a warning when the client certificate configuration looks
+// incomplete.
+func (c *Client) Validate() {
+	if c == nil {
+		return
+	}
+	if (c.Certificate == "") != (c.Key == "") {
+		log.Warn("HttpsClient: both Certificate and Key must be given for mutual TLS to be enabled")
+	}
+}
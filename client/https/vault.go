@@ -0,0 +1,180 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package https
+
+import (
+	"io/ioutil"
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+const vaultURIScheme = "vault://"
+
+// VaultConfig holds the connection parameters used to resolve vault://
+// secret references found in a Client's Certificate or Key.
+type VaultConfig struct {
+	Address string
+	// Token authenticates directly with a Vault token.
+	Token string
+	// TokenFile reads the token from a file instead of embedding it in
+	// the configuration.
+	TokenFile string
+	// RoleID/SecretID authenticate via the AppRole auth method, as an
+	// alternative to Token/TokenFile.
+	RoleID    string
+	SecretID  string
+	CACert    string
+	Namespace string
+}
+
+// secretSource resolves a Certificate/Key/ServerCertificate location into
+// the PEM bytes it names. The filesystem and Vault-backed implementations
+// are interchangeable behind this interface.
+type secretSource interface {
+	Read(location string) ([]byte, error)
+}
+
+// IsVaultURI reports whether location refers to a secret stored in Vault, as
+// opposed to a path on the local filesystem.
+func IsVaultURI(location string) bool {
+	return strings.HasPrefix(location, vaultURIScheme)
+}
+
+// ResolvePEM reads the PEM material named by location, which is either a
+// filesystem path or a "vault://<path>#<field>" URI resolved against vault.
+func ResolvePEM(location string, vault VaultConfig) ([]byte, error) {
+	if location == "" {
+		return nil, nil
+	}
+	var source secretSource
+	if IsVaultURI(location) {
+		source = vaultSecretSource{cfg: vault}
+	} else {
+		source = fileSecretSource{}
+	}
+	return source.Read(location)
+}
+
+type fileSecretSource struct{}
+
+func (fileSecretSource) Read(location string) ([]byte, error) {
+	return ioutil.ReadFile(location)
+}
+
+type vaultSecretSource struct {
+	cfg VaultConfig
+}
+
+func (v vaultSecretSource) Read(location string) ([]byte, error) {
+	path, field, err := parseVaultURI(location)
+	if err != nil {
+		return nil, err
+	}
+	if v.cfg.Address == "" {
+		return nil, errors.Errorf("cannot resolve %q: no Vault config present", location)
+	}
+
+	client, err := newVaultAPIClient(v.cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create Vault client")
+	}
+
+	secret, err := client.Logical().Read(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q from Vault", path)
+	}
+	if secret == nil {
+		return nil, errors.Errorf("no secret found at %q in Vault", path)
+	}
+
+	// KV v2 nests the actual fields under "data".
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		data = secret.Data
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return nil, errors.Errorf("field %q not found (or not a string) at %q in Vault", field, path)
+	}
+
+	return []byte(value), nil
+}
+
+// parseVaultURI splits "vault://secret/data/mender/shell#certificate" into
+// its Vault path ("secret/data/mender/shell") and field name ("certificate").
+func parseVaultURI(uri string) (path string, field string, err error) {
+	rest := strings.TrimPrefix(uri, vaultURIScheme)
+	parts := strings.SplitN(rest, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf(
+			"invalid vault:// URI %q: expected vault://<path>#<field>", uri)
+	}
+	return parts[0], parts[1], nil
+}
+
+func newVaultAPIClient(cfg VaultConfig) (*vaultapi.Client, error) {
+	vc := vaultapi.DefaultConfig()
+	vc.Address = cfg.Address
+	if cfg.CACert != "" {
+		if err := vc.ConfigureTLS(&vaultapi.TLSConfig{CACert: cfg.CACert}); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := vaultapi.NewClient(vc)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Namespace != "" {
+		client.SetNamespace(cfg.Namespace)
+	}
+
+	token, err := vaultToken(cfg, client)
+	if err != nil {
+		return nil, err
+	}
+	client.SetToken(token)
+
+	return client, nil
+}
+
+func vaultToken(cfg VaultConfig, client *vaultapi.Client) (string, error) {
+	if cfg.Token != "" {
+		return cfg.Token, nil
+	}
+	if cfg.TokenFile != "" {
+		data, err := ioutil.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read Vault.TokenFile")
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if cfg.RoleID != "" && cfg.SecretID != "" {
+		secret, err := client.Logical().Write("auth/approle/login", map[string]interface{}{
+			"role_id":   cfg.RoleID,
+			"secret_id": cfg.SecretID,
+		})
+		if err != nil {
+			return "", errors.Wrap(err, "AppRole login to Vault failed")
+		}
+		if secret == nil || secret.Auth == nil {
+			return "", errors.New("AppRole login to Vault returned no auth data")
+		}
+		return secret.Auth.ClientToken, nil
+	}
+	return "", errors.New(
+		"Vault is referenced but none of Token, TokenFile or RoleID/SecretID is configured")
+}
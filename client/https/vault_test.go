@@ -0,0 +1,69 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package https
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsVaultURI(t *testing.T) {
+	assert.True(t, IsVaultURI("vault://secret/data/mender/shell#certificate"))
+	assert.False(t, IsVaultURI("/etc/mender/client.crt"))
+	assert.False(t, IsVaultURI(""))
+}
+
+func TestParseVaultURI(t *testing.T) {
+	path, field, err := parseVaultURI("vault://secret/data/mender/shell#certificate")
+	require.NoError(t, err)
+	assert.Equal(t, "secret/data/mender/shell", path)
+	assert.Equal(t, "certificate", field)
+}
+
+func TestParseVaultURIRejectsMissingField(t *testing.T) {
+	_, _, err := parseVaultURI("vault://secret/data/mender/shell")
+	assert.Error(t, err)
+}
+
+func TestParseVaultURIRejectsMissingPath(t *testing.T) {
+	_, _, err := parseVaultURI("vault://#certificate")
+	assert.Error(t, err)
+}
+
+func TestResolvePEMReadsFromFileWhenNotAVaultURI(t *testing.T) {
+	file, err := ioutil.TempFile("", "mender-shell-pem")
+	require.NoError(t, err)
+	defer func() { _ = file.Close() }()
+
+	_, err = file.WriteString("pem-contents")
+	require.NoError(t, err)
+
+	data, err := ResolvePEM(file.Name(), VaultConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, "pem-contents", string(data))
+}
+
+func TestResolvePEMEmptyLocationIsNotAnError(t *testing.T) {
+	data, err := ResolvePEM("", VaultConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestResolvePEMRequiresVaultAddressForVaultURI(t *testing.T) {
+	_, err := ResolvePEM("vault://secret/data/mender/shell#certificate", VaultConfig{})
+	assert.Error(t, err)
+}
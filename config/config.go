@@ -18,16 +18,31 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/mendersoftware/mender-shell/client/discovery"
 	"github.com/mendersoftware/mender-shell/client/https"
 )
 
 const httpsSchema = "https"
 
+// dropInServersMergeMode controls how the Servers list of a conf.d fragment
+// combines with the Servers list collected from the files loaded so far.
+type dropInServersMergeMode string
+
+const (
+	// serversMergeReplace overwrites the Servers list collected so far
+	// with the fragment's Servers list. This is the default.
+	serversMergeReplace dropInServersMergeMode = "replace"
+	// serversMergeAppend appends the fragment's Servers list to the
+	// Servers list collected so far.
+	serversMergeAppend dropInServersMergeMode = "append"
+)
+
 // MenderShellConfigFromFile holds the configuration settings read from the config file
 type MenderShellConfigFromFile struct {
 	// ClientProtocol "https"
@@ -42,15 +57,38 @@ type MenderShellConfigFromFile struct {
 	ServerURL string
 	// List of available servers, to which client can fall over
 	Servers []https.MenderServer
+	// ServerDiscovery configures a dynamic backend (e.g. Consul) that
+	// replaces the static Servers list at startup and on a refresh
+	// interval. Servers/ServerURL remain the default when unset.
+	ServerDiscovery discovery.Config
 	// The command to run as shell
 	ShellCommand string
 	// Name of the user who owns the shell process
 	User string
+	// Vault holds the connection parameters used to resolve vault://
+	// URIs referenced by HTTPSClient.Certificate or HTTPSClient.Key.
+	// ServerCertificate is handed to the HTTP client as given; a vault://
+	// URI there is not resolved.
+	Vault https.VaultConfig
+	// MaxStreamsPerConnection caps the number of logical shell sessions
+	// multiplexed over a single websocket connection. Zero means
+	// unlimited.
+	MaxStreamsPerConnection int
+	// StreamWriteBuffer sets the per-stream inbound buffer size, in
+	// frames, for multiplexed sessions.
+	StreamWriteBuffer int
 }
 
 // MenderShellConfig holds the configuration settings for the Mender shell client
 type MenderShellConfig struct {
 	MenderShellConfigFromFile
+
+	// Paths the configuration was loaded from, kept so that a later
+	// reload (e.g. triggered by SIGHUP) re-reads the same files and
+	// drop-in directories.
+	MainConfigFile     string
+	FallbackConfigFile string
+	ConfigDirs         []string
 }
 
 // NewMenderShellConfig initializes a new MenderShellConfig struct
@@ -61,10 +99,12 @@ func NewMenderShellConfig() *MenderShellConfig {
 }
 
 // LoadConfig parses the mender configuration json-files
-// (/etc/mender/mender-shell.conf and /var/lib/mender/mender-shell.conf)
-// and loads the values into the MenderShellConfig structure defining high level
-// client configurations.
-func LoadConfig(mainConfigFile string, fallbackConfigFile string) (*MenderShellConfig, error) {
+// (/etc/mender/mender-shell.conf and /var/lib/mender/mender-shell.conf),
+// then overlays any drop-in fragments found in configDirs (scanned in
+// lexical order, e.g. /etc/mender/mender-shell.conf.d/*.conf), and loads the
+// values into the MenderShellConfig structure defining high level client
+// configurations.
+func LoadConfig(mainConfigFile string, fallbackConfigFile string, configDirs ...string) (*MenderShellConfig, error) {
 	// Load fallback configuration first, then main configuration.
 	// It is OK if either file does not exist, so long as the other one does exist.
 	// It is also OK if both files exist.
@@ -81,6 +121,16 @@ func LoadConfig(mainConfigFile string, fallbackConfigFile string) (*MenderShellC
 		return nil, loadErr
 	}
 
+	for _, dir := range configDirs {
+		if loadErr := loadConfigDir(dir, config, &filesLoadedCount); loadErr != nil {
+			return nil, loadErr
+		}
+	}
+
+	config.MainConfigFile = mainConfigFile
+	config.FallbackConfigFile = fallbackConfigFile
+	config.ConfigDirs = configDirs
+
 	log.Debugf("Loaded %d configuration file(s)", filesLoadedCount)
 	if filesLoadedCount == 0 {
 		log.Info("No configuration files present. Using defaults")
@@ -107,8 +157,24 @@ func (c *MenderShellConfig) Validate() error {
 		return errors.New("Both Servers AND ServerURL given in " +
 			"mender-shell.conf")
 	}
+	c.normalizeServerURLs()
+
+	c.HTTPSClient.Validate()
+
+	if err := c.validateVaultReferences(); err != nil {
+		return err
+	}
+
+	log.Debugf("Verified configuration = %#v", c)
+
+	return nil
+}
+
+// normalizeServerURLs trims a possible '/' suffix off every c.Servers entry,
+// which is added back in the URL path, and warns about entries left with no
+// URL at all.
+func (c *MenderShellConfig) normalizeServerURLs() {
 	for i := 0; i < len(c.Servers); i++ {
-		// trim possible '/' suffix, which is added back in URL path
 		if strings.HasSuffix(c.Servers[i].ServerURL, "/") {
 			c.Servers[i].ServerURL =
 				strings.TrimSuffix(
@@ -118,10 +184,30 @@ func (c *MenderShellConfig) Validate() error {
 			log.Warnf("Server entry %d has no associated server URL.", i+1)
 		}
 	}
+}
 
-	c.HTTPSClient.Validate()
-	log.Debugf("Verified configuration = %#v", c)
+// SetServers replaces c.Servers with urls, applying the same URL
+// normalization as Validate. The daemon's server discovery loop calls this to
+// refresh the server list without a restart.
+func (c *MenderShellConfig) SetServers(urls []string) {
+	servers := make([]https.MenderServer, len(urls))
+	for i, u := range urls {
+		servers[i].ServerURL = u
+	}
+	c.Servers = servers
+	c.normalizeServerURLs()
+}
 
+// validateVaultReferences fails clearly when a vault:// URI is used for
+// HTTPSClient or ServerCertificate material but no Vault block was
+// configured to resolve it.
+func (c *MenderShellConfig) validateVaultReferences() error {
+	usesVault := https.IsVaultURI(c.HTTPSClient.Certificate) ||
+		https.IsVaultURI(c.HTTPSClient.Key) ||
+		https.IsVaultURI(c.ServerCertificate)
+	if usesVault && c.Vault.Address == "" {
+		return errors.New("mender-shell.conf references a vault:// URI but Vault.Address is not configured")
+	}
 	return nil
 }
 
@@ -143,6 +229,268 @@ func loadConfigFile(configFile string, config *MenderShellConfig, filesLoadedCou
 	return nil
 }
 
+// loadConfigDir scans dir for *.conf fragments, in lexical order, and
+// overlays each of them onto config in turn.
+func loadConfigDir(dir string, config *MenderShellConfig, filesLoadedCount *int) error {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		return errors.Wrapf(err, "Error scanning configuration directory: %s", dir)
+	}
+
+	for _, configFile := range matches {
+		if loadErr := loadConfigDropIn(configFile, config, filesLoadedCount); loadErr != nil {
+			return loadErr
+		}
+	}
+	return nil
+}
+
+// loadConfigDropIn merges a single conf.d fragment onto config, field by
+// field, so that a fragment setting only e.g. ShellCommand does not clobber
+// fields set by earlier files. The Servers field is the one exception: a
+// fragment may request to have its Servers appended, rather than replace the
+// ones collected so far, by setting "ServersMergeMode": "append".
+func loadConfigDropIn(configFile string, config *MenderShellConfig, filesLoadedCount *int) error {
+	log.Debug("Reading Mender configuration drop-in from file " + configFile)
+	raw, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	if err := mergeConfigFragment(config, raw); err != nil {
+		log.Errorf("Error loading configuration drop-in from file: %s (%s)", configFile, err.Error())
+		return err
+	}
+
+	(*filesLoadedCount)++
+	log.Info("Loaded configuration drop-in file: ", configFile)
+	return nil
+}
+
+// mergeConfigFragment overlays the fields present in raw onto config,
+// leaving fields it does not mention untouched.
+func mergeConfigFragment(config *MenderShellConfig, raw []byte) error {
+	var fragment MenderShellConfigFromFile
+	if err := json.Unmarshal(raw, &fragment); err != nil {
+		return jsonUnmarshalErr(err)
+	}
+
+	var marker struct {
+		ServersMergeMode dropInServersMergeMode
+	}
+	if err := json.Unmarshal(raw, &marker); err != nil {
+		return jsonUnmarshalErr(err)
+	}
+
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &present); err != nil {
+		return jsonUnmarshalErr(err)
+	}
+
+	if _, ok := present["ClientProtocol"]; ok {
+		config.ClientProtocol = fragment.ClientProtocol
+	}
+	if raw, ok := present["HttpsClient"]; ok {
+		if err := mergeHTTPSClientFragment(&config.HTTPSClient, raw, fragment.HTTPSClient); err != nil {
+			return err
+		}
+	}
+	if _, ok := present["SkipVerify"]; ok {
+		config.SkipVerify = fragment.SkipVerify
+	}
+	if _, ok := present["ServerCertificate"]; ok {
+		config.ServerCertificate = fragment.ServerCertificate
+	}
+	if _, ok := present["ServerURL"]; ok {
+		config.ServerURL = fragment.ServerURL
+	}
+	if _, ok := present["Servers"]; ok {
+		if marker.ServersMergeMode == serversMergeAppend {
+			config.Servers = append(config.Servers, fragment.Servers...)
+		} else {
+			config.Servers = fragment.Servers
+		}
+	}
+	if raw, ok := present["ServerDiscovery"]; ok {
+		if err := mergeServerDiscoveryFragment(&config.ServerDiscovery, raw, fragment.ServerDiscovery); err != nil {
+			return err
+		}
+	}
+	if _, ok := present["ShellCommand"]; ok {
+		config.ShellCommand = fragment.ShellCommand
+	}
+	if _, ok := present["User"]; ok {
+		config.User = fragment.User
+	}
+	if raw, ok := present["Vault"]; ok {
+		if err := mergeVaultFragment(&config.Vault, raw, fragment.Vault); err != nil {
+			return err
+		}
+	}
+	if _, ok := present["MaxStreamsPerConnection"]; ok {
+		config.MaxStreamsPerConnection = fragment.MaxStreamsPerConnection
+	}
+	if _, ok := present["StreamWriteBuffer"]; ok {
+		config.StreamWriteBuffer = fragment.StreamWriteBuffer
+	}
+
+	return nil
+}
+
+// mergeHTTPSClientFragment overlays the fields present in raw onto dst,
+// field by field, so that a fragment setting only e.g. Certificate does not
+// clobber a Key set by an earlier file. fragment is raw already unmarshaled
+// into an https.Client; only the fields present in raw are copied from it.
+func mergeHTTPSClientFragment(dst *https.Client, raw json.RawMessage, fragment https.Client) error {
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &present); err != nil {
+		return jsonUnmarshalErr(err)
+	}
+
+	if _, ok := present["Certificate"]; ok {
+		dst.Certificate = fragment.Certificate
+	}
+	if _, ok := present["Key"]; ok {
+		dst.Key = fragment.Key
+	}
+	if _, ok := present["AutoGenerate"]; ok {
+		dst.AutoGenerate = fragment.AutoGenerate
+	}
+	if _, ok := present["AutoGenerateHosts"]; ok {
+		dst.AutoGenerateHosts = fragment.AutoGenerateHosts
+	}
+	if _, ok := present["AutoGenerateValidity"]; ok {
+		dst.AutoGenerateValidity = fragment.AutoGenerateValidity
+	}
+	if _, ok := present["AutoGenerateRenewBefore"]; ok {
+		dst.AutoGenerateRenewBefore = fragment.AutoGenerateRenewBefore
+	}
+
+	return nil
+}
+
+// mergeVaultFragment overlays the fields present in raw onto dst, field by
+// field, so that a fragment setting only e.g. Token does not clobber an
+// Address set by an earlier file.
+func mergeVaultFragment(dst *https.VaultConfig, raw json.RawMessage, fragment https.VaultConfig) error {
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &present); err != nil {
+		return jsonUnmarshalErr(err)
+	}
+
+	if _, ok := present["Address"]; ok {
+		dst.Address = fragment.Address
+	}
+	if _, ok := present["Token"]; ok {
+		dst.Token = fragment.Token
+	}
+	if _, ok := present["TokenFile"]; ok {
+		dst.TokenFile = fragment.TokenFile
+	}
+	if _, ok := present["RoleID"]; ok {
+		dst.RoleID = fragment.RoleID
+	}
+	if _, ok := present["SecretID"]; ok {
+		dst.SecretID = fragment.SecretID
+	}
+	if _, ok := present["CACert"]; ok {
+		dst.CACert = fragment.CACert
+	}
+	if _, ok := present["Namespace"]; ok {
+		dst.Namespace = fragment.Namespace
+	}
+
+	return nil
+}
+
+// mergeServerDiscoveryFragment overlays the fields present in raw onto dst,
+// field by field, recursing into Consul so that a fragment setting only
+// e.g. Consul.Tag does not clobber a Consul.Service set by an earlier file.
+func mergeServerDiscoveryFragment(dst *discovery.Config, raw json.RawMessage, fragment discovery.Config) error {
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &present); err != nil {
+		return jsonUnmarshalErr(err)
+	}
+
+	if _, ok := present["RefreshInterval"]; ok {
+		dst.RefreshInterval = fragment.RefreshInterval
+	}
+	if raw, ok := present["Consul"]; ok {
+		if dst.Consul == nil {
+			dst.Consul = &discovery.ConsulConfig{}
+		}
+		if err := mergeConsulFragment(dst.Consul, raw, fragment.Consul); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeConsulFragment overlays the fields present in raw onto dst, field by
+// field, including the nested TLS block.
+func mergeConsulFragment(dst *discovery.ConsulConfig, raw json.RawMessage, fragment *discovery.ConsulConfig) error {
+	if fragment == nil {
+		return nil
+	}
+
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &present); err != nil {
+		return jsonUnmarshalErr(err)
+	}
+
+	if _, ok := present["Address"]; ok {
+		dst.Address = fragment.Address
+	}
+	if _, ok := present["Datacenter"]; ok {
+		dst.Datacenter = fragment.Datacenter
+	}
+	if _, ok := present["Service"]; ok {
+		dst.Service = fragment.Service
+	}
+	if _, ok := present["Tag"]; ok {
+		dst.Tag = fragment.Tag
+	}
+	if _, ok := present["Scheme"]; ok {
+		dst.Scheme = fragment.Scheme
+	}
+	if _, ok := present["Token"]; ok {
+		dst.Token = fragment.Token
+	}
+	if raw, ok := present["TLS"]; ok {
+		if err := mergeConsulTLSFragment(&dst.TLS, raw, fragment.TLS); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeConsulTLSFragment overlays the fields present in raw onto dst, field
+// by field, so that a fragment setting only e.g. TLS.CAFile does not clobber
+// a TLS.CertFile/KeyFile set by an earlier file.
+func mergeConsulTLSFragment(dst *discovery.ConsulTLSConfig, raw json.RawMessage, fragment discovery.ConsulTLSConfig) error {
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &present); err != nil {
+		return jsonUnmarshalErr(err)
+	}
+
+	if _, ok := present["CAFile"]; ok {
+		dst.CAFile = fragment.CAFile
+	}
+	if _, ok := present["CertFile"]; ok {
+		dst.CertFile = fragment.CertFile
+	}
+	if _, ok := present["KeyFile"]; ok {
+		dst.KeyFile = fragment.KeyFile
+	}
+	if _, ok := present["InsecureSkipVerify"]; ok {
+		dst.InsecureSkipVerify = fragment.InsecureSkipVerify
+	}
+
+	return nil
+}
+
 func readConfigFile(config interface{}, fileName string) error {
 	// Reads mender configuration (JSON) file.
 	log.Debug("Reading Mender configuration from file " + fileName)
@@ -152,21 +500,30 @@ func readConfigFile(config interface{}, fileName string) error {
 	}
 
 	if err := json.Unmarshal(conf, &config); err != nil {
-		switch err.(type) {
-		case *json.SyntaxError:
-			return errors.New("Error parsing mender configuration file: " + err.Error())
-		}
-		return errors.New("Error parsing config file: " + err.Error())
+		return jsonUnmarshalErr(err)
 	}
 
 	return nil
 }
 
+func jsonUnmarshalErr(err error) error {
+	switch err.(type) {
+	case *json.SyntaxError:
+		return errors.New("Error parsing mender configuration file: " + err.Error())
+	}
+	return errors.New("Error parsing config file: " + err.Error())
+}
+
 // maybeHTTPSClient returns the HTTPSClient config only when both
-// certificate and key are provided
+// certificate and key are provided, resolving them (including any vault://
+// URIs) into in-memory PEM material along the way.
 func maybeHTTPSClient(c *MenderShellConfig) *https.Client {
 	c.HTTPSClient.Validate()
 	if c.HTTPSClient.Certificate != "" && c.HTTPSClient.Key != "" {
+		if err := c.HTTPSClient.Resolve(c.Vault); err != nil {
+			log.Errorf("Failed to resolve HttpsClient certificate material: %s", err.Error())
+			return nil
+		}
 		return &c.HTTPSClient
 	}
 	return nil
@@ -0,0 +1,79 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mendersoftware/mender-shell/client/discovery"
+)
+
+// TestMergeConfigFragmentPreservesUnmentionedFields guards against the
+// whole-struct-replace bug class: a drop-in fragment that sets only one
+// field of a nested struct must not wipe out sibling fields collected from
+// earlier files.
+func TestMergeConfigFragmentPreservesUnmentionedFields(t *testing.T) {
+	config := NewMenderShellConfig()
+	config.HTTPSClient.Certificate = "main-cert.pem"
+	config.HTTPSClient.Key = "main-key.pem"
+	config.ServerDiscovery.Consul = &discovery.ConsulConfig{
+		Service: "mender-shell",
+		TLS: discovery.ConsulTLSConfig{
+			CertFile: "main-consul-cert.pem",
+			KeyFile:  "main-consul-key.pem",
+		},
+	}
+
+	fragment := []byte(`{
+		"HttpsClient": {"Certificate": "dropin-cert.pem"},
+		"ServerDiscovery": {"Consul": {"TLS": {"CAFile": "dropin-ca.pem"}}}
+	}`)
+
+	require.NoError(t, mergeConfigFragment(config, fragment))
+
+	assert.Equal(t, "dropin-cert.pem", config.HTTPSClient.Certificate,
+		"field mentioned in the fragment should be overlaid")
+	assert.Equal(t, "main-key.pem", config.HTTPSClient.Key,
+		"field not mentioned in the fragment must survive the merge")
+
+	assert.Equal(t, "mender-shell", config.ServerDiscovery.Consul.Service,
+		"Consul field not mentioned in the fragment must survive the merge")
+	assert.Equal(t, "dropin-ca.pem", config.ServerDiscovery.Consul.TLS.CAFile,
+		"TLS field mentioned in the fragment should be overlaid")
+	assert.Equal(t, "main-consul-cert.pem", config.ServerDiscovery.Consul.TLS.CertFile,
+		"TLS field not mentioned in the fragment must survive the merge")
+	assert.Equal(t, "main-consul-key.pem", config.ServerDiscovery.Consul.TLS.KeyFile,
+		"TLS field not mentioned in the fragment must survive the merge")
+}
+
+func TestMergeConfigFragmentServersMergeModes(t *testing.T) {
+	config := NewMenderShellConfig()
+	config.SetServers([]string{"https://a.example.com"})
+
+	require.NoError(t, mergeConfigFragment(config, []byte(
+		`{"Servers": [{"ServerURL": "https://b.example.com"}], "ServersMergeMode": "append"}`)))
+
+	require.Len(t, config.Servers, 2)
+	assert.Equal(t, "https://a.example.com", config.Servers[0].ServerURL)
+	assert.Equal(t, "https://b.example.com", config.Servers[1].ServerURL)
+
+	require.NoError(t, mergeConfigFragment(config, []byte(
+		`{"Servers": [{"ServerURL": "https://c.example.com"}]}`)))
+
+	require.Len(t, config.Servers, 1)
+	assert.Equal(t, "https://c.example.com", config.Servers[0].ServerURL)
+}